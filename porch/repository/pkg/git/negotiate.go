@@ -0,0 +1,195 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Capabilities we advertise/honor for the smart HTTP v0/v1 protocol.
+// See https://git-scm.com/docs/protocol-capabilities
+const (
+	capMultiAckDetailed = "multi_ack_detailed"
+	capNoDone           = "no-done"
+	capOFSDelta         = "ofs-delta"
+	capSideBand64k      = "side-band-64k"
+	capThinPack         = "thin-pack"
+)
+
+// uploadPackRequest is the parsed form of the want/have/done lines a client
+// sends at the start of git-upload-pack. Shallows/Deepen are parsed (so a
+// malformed line is still reported as such) but not honored: we don't
+// advertise shallow-clone support, so a well-behaved client never sets
+// them, and isShallowRequest lets the handlers reject one explicitly if it
+// does anyway.
+type uploadPackRequest struct {
+	Wants        []plumbing.Hash
+	Haves        []plumbing.Hash
+	Shallows     []plumbing.Hash
+	Deepen       int
+	Done         bool
+	Capabilities []string
+}
+
+// isShallowRequest reports whether req asks for a shallow clone/fetch,
+// which this server doesn't implement.
+func (req *uploadPackRequest) isShallowRequest() bool {
+	return len(req.Shallows) > 0 || req.Deepen != 0
+}
+
+// hasCapability reports whether name is present in the capability list.
+func hasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUploadPackRequest reads the pktline-framed want/have/shallow/deepen/done
+// lines that make up a (v0/v1) git-upload-pack request body.
+//
+// The request is terminated by a "done" line, matching what real git clients
+// send; a flush-pkt between the want/have block and "done" is ignored.
+func parseUploadPackRequest(scanner *pktline.Scanner) (*uploadPackRequest, error) {
+	req := &uploadPackRequest{}
+	firstWant := true
+
+	for scanner.Scan() {
+		line := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+		if line == "" {
+			// flush-pkt; carries no information for us here.
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "want":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed want line %q", line)
+			}
+			h, err := parseHash(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed want line %q: %w", line, err)
+			}
+			if firstWant {
+				req.Capabilities = fields[2:]
+				firstWant = false
+			}
+			req.Wants = append(req.Wants, h)
+
+		case "have":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed have line %q", line)
+			}
+			h, err := parseHash(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed have line %q: %w", line, err)
+			}
+			req.Haves = append(req.Haves, h)
+
+		case "shallow":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed shallow line %q", line)
+			}
+			h, err := parseHash(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed shallow line %q: %w", line, err)
+			}
+			req.Shallows = append(req.Shallows, h)
+
+		case "deepen":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed deepen line %q", line)
+			}
+			depth, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed deepen line %q: %w", line, err)
+			}
+			req.Deepen = depth
+
+		case "done":
+			req.Done = true
+			return req, nil
+
+		default:
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error parsing request: %w", err)
+	}
+
+	return req, nil
+}
+
+// negotiationResult is the outcome of computing what a client needs sent,
+// given the wants/haves it reported.
+type negotiationResult struct {
+	// Objects are the hashes that must be packed and sent to the client.
+	Objects []plumbing.Hash
+	// Common are the haves we recognized as objects we actually have, i.e.
+	// ancestors shared between client and server.
+	Common []plumbing.Hash
+}
+
+// negotiateObjects walks from wants, stopping the descent at any have the
+// server actually possesses, and returns the objects that must be packed.
+//
+// walker should be freshly constructed; negotiateObjects configures its
+// stopAt set from haves before walking.
+func negotiateObjects(walker *objectWalker, wants, haves []plumbing.Hash) (*negotiationResult, error) {
+	common := make([]plumbing.Hash, 0, len(haves))
+	stopAt := make(map[plumbing.Hash]struct{}, len(haves))
+	for _, h := range haves {
+		if _, err := object.GetObject(walker.Storer, h); err != nil {
+			// Client claimed to have an object we don't recognize; we can't
+			// use it to prune the walk, and it isn't "common".
+			continue
+		}
+		stopAt[h] = struct{}{}
+		common = append(common, h)
+	}
+	walker.stopAt = stopAt
+
+	for _, want := range wants {
+		if err := walker.walkObjectTree(want); err != nil {
+			return nil, fmt.Errorf("error walking from want %s: %w", want, err)
+		}
+	}
+
+	objects := make([]plumbing.Hash, 0, len(walker.seen))
+	for h := range walker.seen {
+		if _, isHave := stopAt[h]; isHave {
+			// The have itself is already on the client; don't resend it.
+			continue
+		}
+		objects = append(objects, h)
+	}
+
+	return &negotiationResult{Objects: objects, Common: common}, nil
+}
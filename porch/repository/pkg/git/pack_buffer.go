@@ -0,0 +1,156 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PackOptions configures how GitServer builds the packfiles it sends to
+// clients.
+type PackOptions struct {
+	// Window is the sliding window size passed to the packfile encoder for
+	// delta compression; 0 disables delta compression entirely.
+	Window uint
+	// UseRefDeltas forces ref-deltas instead of offset-deltas (ofs-delta),
+	// even if the client advertised ofs-delta support.
+	UseRefDeltas bool
+	// BufferDir is the directory temp files are created in when a pack
+	// grows past MaxMemBytes. Empty means os.TempDir().
+	BufferDir string
+	// MaxMemBytes is the largest pack we'll buffer in memory; packs larger
+	// than this spill to a temp file under BufferDir.
+	MaxMemBytes int64
+}
+
+// DefaultPackOptions returns the options GitServer uses when none are set
+// explicitly.
+func DefaultPackOptions() PackOptions {
+	return PackOptions{
+		Window:      10,
+		MaxMemBytes: 10 << 20, // 10MiB
+	}
+}
+
+// packSpool buffers a packfile being encoded, keeping it in memory while
+// it's small and spilling to a temp file once it grows past maxMemBytes, so
+// that the caller can learn the pack's final size (for Content-Length)
+// before streaming it to the client.
+type packSpool struct {
+	maxMemBytes int64
+	bufferDir   string
+
+	buf  bytes.Buffer
+	file *os.File
+}
+
+func (p *packSpool) Write(data []byte) (int, error) {
+	if p.file != nil {
+		return p.file.Write(data)
+	}
+
+	if int64(p.buf.Len()+len(data)) <= p.maxMemBytes {
+		return p.buf.Write(data)
+	}
+
+	f, err := os.CreateTemp(p.bufferDir, "git-pack-*.pack")
+	if err != nil {
+		return 0, fmt.Errorf("error creating pack buffer file: %w", err)
+	}
+	if _, err := f.Write(p.buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, fmt.Errorf("error spilling pack buffer to disk: %w", err)
+	}
+	p.buf.Reset()
+	p.file = f
+
+	return f.Write(data)
+}
+
+// Finalize returns a reader over everything written so far (seeked back to
+// the start, for the temp-file case) along with its total size. The caller
+// must Close the reader once done with it, which removes any backing temp
+// file.
+func (p *packSpool) Finalize() (io.ReadCloser, int64, error) {
+	if p.file == nil {
+		return io.NopCloser(bytes.NewReader(p.buf.Bytes())), int64(p.buf.Len()), nil
+	}
+
+	size, err := p.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error sizing pack buffer file: %w", err)
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("error rewinding pack buffer file: %w", err)
+	}
+
+	return &tempFilePackReader{f: p.file}, size, nil
+}
+
+// tempFilePackReader deletes its backing temp file on Close.
+type tempFilePackReader struct {
+	f *os.File
+}
+
+func (t *tempFilePackReader) Read(p []byte) (int, error) {
+	return t.f.Read(p)
+}
+
+func (t *tempFilePackReader) Close() error {
+	name := t.f.Name()
+	err := t.f.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// sideBandFramedLen returns the number of bytes a payload of length n takes
+// up once split into side-band-64k pktlines (each chunk carries a 4 byte
+// length prefix and a 1 byte band indicator in addition to its data).
+func sideBandFramedLen(n int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	fullChunks := n / maxSideBandChunk
+	remainder := n % maxSideBandChunk
+	total := fullChunks * (maxSideBandChunk + 5)
+	if remainder > 0 {
+		total += remainder + 5
+	}
+	return total
+}
+
+// copyToSideBand streams src to a side-band-64k writer, one pktline-framed
+// chunk at a time.
+func copyToSideBand(out *PacketLineWriter, band byte, src io.Reader) error {
+	buf := make([]byte, maxSideBandChunk)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			out.WriteBand(band, buf[:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"k8s.io/klog/v2"
+)
+
+// v2Commands dispatches the "command=<name>" line a protocol v2 client sends
+// at the start of a git-upload-pack request.
+var v2Commands = map[string]func(*GitServer, http.ResponseWriter, *http.Request, []string) error{
+	"ls-refs": (*GitServer).serveLsRefsV2,
+	"fetch":   (*GitServer).serveFetchV2,
+}
+
+// serveGitInfoRefsV2 replies to the discovery request with the protocol v2
+// capability advertisement instead of the v0/v1 ref list: the ref list is
+// fetched separately via the "ls-refs" command.
+func (s *GitServer) serveGitInfoRefsV2(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	gw := NewPacketLineWriter(w)
+	gw.WriteLine("version 2")
+	gw.WriteLine("ls-refs=unborn")
+	gw.WriteLine("fetch")
+	gw.WriteLine("object-format=sha1")
+	gw.WriteZeroPacketLine()
+
+	if err := gw.Flush(); err != nil {
+		klog.Warningf("error from flush: %v", err)
+	}
+	return nil
+}
+
+// serveGitUploadPackV2 handles a protocol v2 request. v2 requests are framed
+// as a "command=<name>" line, followed by capability and argument lines,
+// terminated by a flush-pkt; we don't distinguish the delim-pkt that
+// separates capabilities from arguments from the terminating flush-pkt,
+// since commands here don't need that distinction to operate.
+func (s *GitServer) serveGitUploadPackV2(w http.ResponseWriter, r *http.Request) error {
+	scanner := pktline.NewScanner(r.Body)
+
+	var command string
+	var args []string
+	for scanner.Scan() {
+		line := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+		if line == "" {
+			continue
+		}
+		if command == "" && strings.HasPrefix(line, "command=") {
+			command = strings.TrimPrefix(line, "command=")
+			continue
+		}
+		args = append(args, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error parsing v2 request: %w", err)
+	}
+
+	handler, ok := v2Commands[command]
+	if !ok {
+		return fmt.Errorf("unsupported v2 command %q", command)
+	}
+
+	klog.V(2).Infof("v2 command=%s args=%v", command, args)
+	return handler(s, w, r, args)
+}
+
+// serveLsRefsV2 implements the v2 "ls-refs" command: it mirrors the
+// reference-iteration logic of serveGitInfoRefs, without the v0 capability
+// line and NUL-separated first ref.
+func (s *GitServer) serveLsRefsV2(w http.ResponseWriter, r *http.Request, args []string) error {
+	refs, err := resolvedRefs(repoFromContext(r.Context()))
+	if err != nil {
+		return fmt.Errorf("error iterating through references: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	gw := NewPacketLineWriter(w)
+	for _, ref := range refs {
+		gw.WriteLine(fmt.Sprintf("%s %s", ref.Hash().String(), ref.Name()))
+	}
+
+	gw.WriteZeroPacketLine()
+	if err := gw.Flush(); err != nil {
+		klog.Warningf("error from flush: %v", err)
+	}
+	return nil
+}
+
+// serveFetchV2 implements the v2 "fetch" command: the same want/have
+// negotiation as the v0/v1 upload-pack path, framed as the
+// acknowledgments/packfile sections the bare "fetch" capability describes.
+func (s *GitServer) serveFetchV2(w http.ResponseWriter, r *http.Request, args []string) error {
+	repo := repoFromContext(r.Context())
+
+	req, err := parseFetchArgsV2(args)
+	if err != nil {
+		return fmt.Errorf("error parsing fetch arguments: %w", err)
+	}
+	if req.isShallowRequest() {
+		// We don't advertise the "shallow" fetch feature, so a well-behaved
+		// client won't send these; reject explicitly rather than silently
+		// sending full history.
+		return fmt.Errorf("shallow clones are not supported")
+	}
+
+	walker := newObjectWalker(repo.Storer)
+	result, err := negotiateObjects(walker, req.Wants, req.Haves)
+	if err != nil {
+		return fmt.Errorf("error negotiating objects: %w", err)
+	}
+
+	// As in the v0/v1 path, the acknowledgments/packfile preamble is built
+	// into its own buffer so its size can be folded into the Content-Length
+	// we send once the packfile (encoded below) is ready.
+	//
+	// Per gitprotocol-v2, the acknowledgments section is separated from the
+	// packfile section by a delim-pkt, and the packfile section is ended by
+	// the flush-pkt that ends the whole response; a plain clone with no
+	// haves omits the acknowledgments section entirely.
+	var preamble bytes.Buffer
+	preWriter := NewPacketLineWriter(&preamble)
+	if len(req.Haves) > 0 {
+		preWriter.WriteLine("acknowledgments")
+		if len(result.Common) == 0 {
+			preWriter.WriteLine("NAK")
+		} else {
+			for _, h := range result.Common {
+				preWriter.WriteLine(fmt.Sprintf("ACK %s", h))
+			}
+			if !req.Done {
+				preWriter.WriteLine("ready")
+			}
+		}
+		preWriter.WriteDelimPacketLine()
+	}
+	preWriter.WriteLine("packfile")
+	if err := preWriter.Flush(); err != nil {
+		return fmt.Errorf("error building response preamble: %w", err)
+	}
+
+	spool := &packSpool{maxMemBytes: s.PackOptions.MaxMemBytes, bufferDir: s.PackOptions.BufferDir}
+	packFileEncoder := packfile.NewEncoder(spool, repo.Storer, s.PackOptions.UseRefDeltas)
+	if _, err := packFileEncoder.Encode(result.Objects, s.PackOptions.Window); err != nil {
+		return fmt.Errorf("error encoding packfile: %w", err)
+	}
+	packReader, packSize, err := spool.Finalize()
+	if err != nil {
+		return fmt.Errorf("error finalizing packfile buffer: %w", err)
+	}
+	defer packReader.Close()
+
+	contentLength := int64(preamble.Len()) + sideBandFramedLen(packSize) + 4 // + trailing flush-pkt
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(preamble.Bytes()); err != nil {
+		klog.Warningf("error writing response preamble: %v", err)
+		return nil // Too late
+	}
+
+	gw := NewPacketLineWriter(w)
+	if err := copyToSideBand(gw, sideBandData, packReader); err != nil {
+		klog.Warningf("error streaming packfile: %v", err)
+		return nil
+	}
+	gw.WriteZeroPacketLine()
+	if err := gw.Flush(); err != nil {
+		klog.Warningf("error flushing response: %v", err)
+	}
+	return nil
+}
+
+// parseFetchArgsV2 parses the argument lines of a v2 "fetch" command; these
+// carry the same want/have/shallow/deepen/done vocabulary as v0/v1, just
+// without NUL-separated capabilities on the first want line.
+func parseFetchArgsV2(args []string) (*uploadPackRequest, error) {
+	req := &uploadPackRequest{}
+	for _, line := range args {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "want":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed want line %q", line)
+			}
+			h, err := parseHash(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed want line %q: %w", line, err)
+			}
+			req.Wants = append(req.Wants, h)
+		case "have":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed have line %q", line)
+			}
+			h, err := parseHash(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed have line %q: %w", line, err)
+			}
+			req.Haves = append(req.Haves, h)
+		case "shallow":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed shallow line %q", line)
+			}
+			h, err := parseHash(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed shallow line %q: %w", line, err)
+			}
+			req.Shallows = append(req.Shallows, h)
+		case "deepen":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed deepen line %q", line)
+			}
+			depth, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed deepen line %q: %w", line, err)
+			}
+			req.Deepen = depth
+		case "done":
+			req.Done = true
+		default:
+			// Unrecognized fetch arguments (e.g. "thin-pack", "ofs-delta",
+			// "filter ...") are accepted but not acted on.
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"errors"
+	"fmt"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// refUpdateResult is the validated outcome of one client-requested ref
+// update. err is nil if the update's precondition and connectivity checks
+// passed.
+type refUpdateResult struct {
+	update RefUpdate
+	err    error
+}
+
+// validateRefUpdates checks each update's non-force-push precondition (From
+// must match the ref's value before the push) and, for anything but a
+// deletion, that the object graph rooted at To is fully connected. It
+// doesn't apply any of the updates.
+func validateRefUpdates(repo *gogit.Repository, updates []RefUpdate) []refUpdateResult {
+	results := make([]refUpdateResult, len(updates))
+	for i, u := range updates {
+		results[i] = refUpdateResult{update: u, err: validateRefUpdate(repo, u)}
+	}
+	return results
+}
+
+// firstFailedUpdate returns the first result with a non-nil err, or nil if
+// every update passed validation.
+func firstFailedUpdate(results []refUpdateResult) *refUpdateResult {
+	for i := range results {
+		if results[i].err != nil {
+			return &results[i]
+		}
+	}
+	return nil
+}
+
+func validateRefUpdate(repo *gogit.Repository, u RefUpdate) error {
+	current, err := repo.Storer.Reference(plumbing.ReferenceName(u.Ref))
+	switch {
+	case err == nil:
+		if current.Hash() != u.From {
+			return fmt.Errorf("stale info: expected %s, ref is at %s", u.From, current.Hash())
+		}
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		if !u.From.IsZero() {
+			return fmt.Errorf("stale info: expected %s, ref does not exist", u.From)
+		}
+	default:
+		return fmt.Errorf("error reading current value of %s: %w", u.Ref, err)
+	}
+
+	if u.To.IsZero() {
+		// Deleting the ref: nothing to check on the target side.
+		return nil
+	}
+
+	walker := newObjectWalker(repo.Storer)
+	if err := walker.walkObjectTree(u.To); err != nil {
+		return fmt.Errorf("incomplete object graph rooted at %s: %w", u.To, err)
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/klog/v2"
+)
+
+// refsAPIPrefix is the base path of the refs REST API, mirroring the shape
+// of the Gitea/GitHub refs API: /repos/{owner}/{repo}/git/refs[/*ref]
+const refsAPIPrefix = "/api/v1/repos/"
+
+// refObject is the JSON shape of a single git object referenced by a ref,
+// e.g. {"sha": "...", "type": "commit"}.
+type refObject struct {
+	SHA  string `json:"sha"`
+	Type string `json:"type"`
+}
+
+// refResponse is the JSON shape returned for a single reference. Peeled is
+// only set for annotated tags, and holds the (possibly further-peeled)
+// non-tag object the tag ultimately points at.
+type refResponse struct {
+	Ref    string     `json:"ref"`
+	Object refObject  `json:"object"`
+	Peeled *refObject `json:"peeled,omitempty"`
+}
+
+// createRefRequest is the JSON body expected by POST .../git/refs.
+type createRefRequest struct {
+	Ref string `json:"ref"`
+	SHA string `json:"sha"`
+}
+
+// updateRefRequest is the JSON body expected by PATCH .../git/refs/<ref>.
+// Force bypasses the fast-forward check updateRefAPI otherwise requires.
+type updateRefRequest struct {
+	SHA   string `json:"sha"`
+	Force bool   `json:"force,omitempty"`
+}
+
+// parseRefsAPIPath splits a refs API request path into the owner/repo it
+// names and the ref path below .../git/refs (empty for the collection
+// endpoint itself).
+func parseRefsAPIPath(path string) (owner, repoName, refPath string, ok bool) {
+	rest := strings.TrimPrefix(path, refsAPIPrefix)
+	parts := strings.SplitN(rest, "/", 4)
+	if len(parts) < 3 || parts[2] != "git" {
+		return "", "", "", false
+	}
+
+	var afterGit string
+	if len(parts) == 4 {
+		afterGit = parts[3]
+	}
+	if afterGit != "refs" && !strings.HasPrefix(afterGit, "refs/") {
+		return "", "", "", false
+	}
+
+	refPath = strings.TrimPrefix(strings.TrimPrefix(afterGit, "refs"), "/")
+	return parts[0], parts[1], refPath, true
+}
+
+// serveRefsAPI implements the JSON REST surface for listing, creating,
+// updating, and deleting refs, so test harnesses can inspect and mutate the
+// mock repo without speaking the git wire protocol.
+func (s *GitServer) serveRefsAPI(w http.ResponseWriter, r *http.Request) error {
+	_, _, refPath, ok := parseRefsAPIPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	repo := repoFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		if refPath == "" {
+			return listRefsAPI(w, repo)
+		}
+		return getRefAPI(w, repo, refPath)
+	case http.MethodPost:
+		if refPath != "" {
+			return writeJSONError(w, http.StatusMethodNotAllowed, "cannot POST to a specific ref")
+		}
+		return createRefAPI(w, r, repo)
+	case http.MethodPut, http.MethodPatch:
+		if refPath == "" {
+			return writeJSONError(w, http.StatusMethodNotAllowed, "ref name is required")
+		}
+		return updateRefAPI(w, r, repo, refPath)
+	case http.MethodDelete:
+		if refPath == "" {
+			return writeJSONError(w, http.StatusMethodNotAllowed, "ref name is required")
+		}
+		return deleteRefAPI(w, repo, refPath)
+	default:
+		return writeJSONError(w, http.StatusMethodNotAllowed, "unsupported method %q", r.Method)
+	}
+}
+
+func listRefsAPI(w http.ResponseWriter, repo *gogit.Repository) error {
+	refs, err := resolvedRefs(repo)
+	if err != nil {
+		return fmt.Errorf("error listing references: %w", err)
+	}
+
+	out := make([]refResponse, 0, len(refs))
+	for _, ref := range refs {
+		resp, err := buildRefResponse(repo, ref)
+		if err != nil {
+			klog.Warningf("skipping ref %q: %v", ref.Name(), err)
+			continue
+		}
+		out = append(out, *resp)
+	}
+
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func getRefAPI(w http.ResponseWriter, repo *gogit.Repository, refName string) error {
+	ref, err := findRef(repo, refName)
+	if err != nil {
+		return writeJSONError(w, http.StatusNotFound, "reference %q not found", refName)
+	}
+
+	resp, err := buildRefResponse(repo, ref)
+	if err != nil {
+		return fmt.Errorf("error resolving reference %q: %w", ref.Name(), err)
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+func createRefAPI(w http.ResponseWriter, r *http.Request, repo *gogit.Repository) error {
+	var req createRefRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	if req.Ref == "" {
+		return writeJSONError(w, http.StatusBadRequest, "ref is required")
+	}
+
+	hash, err := parseHash(req.SHA)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid sha %q", req.SHA)
+	}
+	if _, err := object.GetObject(repo.Storer, hash); err != nil {
+		return writeJSONError(w, http.StatusUnprocessableEntity, "object %q not found", req.SHA)
+	}
+
+	name := plumbing.ReferenceName(req.Ref)
+	if _, err := repo.Storer.Reference(name); err == nil {
+		return writeJSONError(w, http.StatusConflict, "reference %q already exists", req.Ref)
+	}
+
+	ref := plumbing.NewHashReference(name, hash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		return fmt.Errorf("error creating reference %q: %w", req.Ref, err)
+	}
+
+	resp, err := buildRefResponse(repo, ref)
+	if err != nil {
+		return fmt.Errorf("error resolving reference %q: %w", req.Ref, err)
+	}
+
+	return writeJSON(w, http.StatusCreated, resp)
+}
+
+func updateRefAPI(w http.ResponseWriter, r *http.Request, repo *gogit.Repository, refName string) error {
+	var req updateRefRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid request body: %v", err)
+	}
+
+	hash, err := parseHash(req.SHA)
+	if err != nil {
+		return writeJSONError(w, http.StatusBadRequest, "invalid sha %q", req.SHA)
+	}
+	if _, err := object.GetObject(repo.Storer, hash); err != nil {
+		return writeJSONError(w, http.StatusUnprocessableEntity, "object %q not found", req.SHA)
+	}
+
+	existing, err := findRef(repo, refName)
+	if err != nil {
+		return writeJSONError(w, http.StatusNotFound, "reference %q not found", refName)
+	}
+
+	if !req.Force {
+		ff, err := isFastForward(repo, existing.Hash(), hash)
+		if err != nil {
+			return writeJSONError(w, http.StatusConflict, "cannot verify update to %q is a fast-forward: %v", existing.Name(), err)
+		}
+		if !ff {
+			return writeJSONError(w, http.StatusConflict, "update to %q is not a fast-forward; set force to override", existing.Name())
+		}
+	}
+
+	ref := plumbing.NewHashReference(existing.Name(), hash)
+	if err := repo.Storer.SetReference(ref); err != nil {
+		return fmt.Errorf("error updating reference %q: %w", existing.Name(), err)
+	}
+
+	resp, err := buildRefResponse(repo, ref)
+	if err != nil {
+		return fmt.Errorf("error resolving reference %q: %w", existing.Name(), err)
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+func deleteRefAPI(w http.ResponseWriter, repo *gogit.Repository, refName string) error {
+	existing, err := findRef(repo, refName)
+	if err != nil {
+		return writeJSONError(w, http.StatusNotFound, "reference %q not found", refName)
+	}
+
+	if err := repo.Storer.RemoveReference(existing.Name()); err != nil {
+		return fmt.Errorf("error deleting reference %q: %w", existing.Name(), err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// isFastForward reports whether moving a ref from from to to only adds
+// history, i.e. whether from is an ancestor of to. Non-commit objects (an
+// annotated tag or a blob, say) can't be checked this way and are reported
+// as an error, leaving it to the caller to decide how to treat that.
+func isFastForward(repo *gogit.Repository, from, to plumbing.Hash) (bool, error) {
+	if from == to {
+		return true, nil
+	}
+	fromCommit, err := object.GetCommit(repo.Storer, from)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a commit: %w", from, err)
+	}
+	toCommit, err := object.GetCommit(repo.Storer, to)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a commit: %w", to, err)
+	}
+	return fromCommit.IsAncestor(toCommit)
+}
+
+// findRef resolves refName to a reference, trying it first as a literal
+// reference name (so e.g. "HEAD" and fully-qualified names work), then
+// under refs/.
+func findRef(repo *gogit.Repository, refName string) (*plumbing.Reference, error) {
+	for _, candidate := range []plumbing.ReferenceName{
+		plumbing.ReferenceName(refName),
+		plumbing.ReferenceName("refs/" + refName),
+	} {
+		if ref, err := repo.Reference(candidate, true); err == nil {
+			return plumbing.NewHashReference(candidate, ref.Hash()), nil
+		}
+	}
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+// buildRefResponse resolves ref's target object (and, for annotated tags,
+// its peeled target) into the API's JSON shape.
+func buildRefResponse(repo *gogit.Repository, ref *plumbing.Reference) (*refResponse, error) {
+	obj, err := object.GetObject(repo.Storer, ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("getting object %s: %w", ref.Hash(), err)
+	}
+
+	resp := &refResponse{
+		Ref: string(ref.Name()),
+		Object: refObject{
+			SHA:  ref.Hash().String(),
+			Type: obj.Type().String(),
+		},
+	}
+
+	tag, ok := obj.(*object.Tag)
+	for ok {
+		target, err := object.GetObject(repo.Storer, tag.Target)
+		if err != nil {
+			return nil, fmt.Errorf("getting peeled object %s: %w", tag.Target, err)
+		}
+		resp.Peeled = &refObject{SHA: tag.Target.String(), Type: target.Type().String()}
+		tag, ok = target.(*object.Tag)
+	}
+
+	return resp, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, args ...interface{}) error {
+	return writeJSON(w, status, map[string]string{"message": fmt.Sprintf(format, args...)})
+}
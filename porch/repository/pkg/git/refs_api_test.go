@@ -0,0 +1,109 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// newTestRefsAPIServer sets up a repo with two commits on Main (commit1,
+// then commit2) behind a GitServer, for exercising the refs REST API.
+func newTestRefsAPIServer(t *testing.T) (server *httptest.Server, repo *gogit.Repository, commit1, commit2 plumbing.Hash) {
+	t.Helper()
+
+	repo, commit1 = newTestRepo(t)
+	commit2 = addCommit(t, repo, commit1, "Second commit")
+
+	s, err := NewGitServer()
+	if err != nil {
+		t.Fatalf("NewGitServer: %v", err)
+	}
+	s.RegisterRepo("/acme/demo.git", repo, RepoOptions{})
+	server = httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server, repo, commit1, commit2
+}
+
+func patchRefAPI(t *testing.T, serverURL string, sha string, force bool) *http.Response {
+	t.Helper()
+
+	body, err := json.Marshal(updateRefRequest{SHA: sha, Force: force})
+	if err != nil {
+		t.Fatalf("marshaling request: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPatch, serverURL+"/api/v1/repos/acme/demo/git/refs/heads/main", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PATCH refs API: %v", err)
+	}
+	defer resp.Body.Close()
+	return resp
+}
+
+func TestUpdateRefAPI(t *testing.T) {
+	t.Run("rejects an unknown sha", func(t *testing.T) {
+		server, _, _, _ := newTestRefsAPIServer(t)
+		resp := patchRefAPI(t, server.URL, "1111111111111111111111111111111111111111", false)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+		}
+	})
+
+	t.Run("rejects a non-fast-forward without force", func(t *testing.T) {
+		server, repo, commit1, commit2 := newTestRefsAPIServer(t)
+
+		// commit1 is main's parent, not a descendant, so moving main to it
+		// is not a fast-forward.
+		resp := patchRefAPI(t, server.URL, commit1.String(), false)
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusConflict)
+		}
+
+		ref, err := repo.Reference(Main, true)
+		if err != nil {
+			t.Fatalf("resolving %s: %v", Main, err)
+		}
+		if ref.Hash() != commit2 {
+			t.Errorf("%s = %s after rejected update, want unchanged %s", Main, ref.Hash(), commit2)
+		}
+	})
+
+	t.Run("force bypasses the fast-forward check", func(t *testing.T) {
+		server, repo, commit1, _ := newTestRefsAPIServer(t)
+
+		resp := patchRefAPI(t, server.URL, commit1.String(), true)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+
+		ref, err := repo.Reference(Main, true)
+		if err != nil {
+			t.Fatalf("resolving %s: %v", Main, err)
+		}
+		if ref.Hash() != commit1 {
+			t.Errorf("%s = %s after forced update, want %s", Main, ref.Hash(), commit1)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	gogit "github.com/go-git/go-git/v5"
+	"k8s.io/klog/v2"
+)
+
+// ErrUnauthorized is returned by an Authorizer to indicate that the request
+// should be rejected with a 401, prompting the client to (re-)authenticate.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authorizer decides whether a request may access a registered repo.
+// write is true for operations that mutate the repo (git-receive-pack, and
+// the mutating REST ref endpoints); false for read-only operations.
+// Implementations should return ErrUnauthorized (or an error wrapping it) to
+// reject the request with a 401.
+type Authorizer interface {
+	Authorize(r *http.Request, write bool) error
+}
+
+// RepoOptions configures how a registered repo is served.
+type RepoOptions struct {
+	// Authorizer is consulted before upload-pack, receive-pack, and the
+	// refs REST API. A nil Authorizer allows all requests.
+	Authorizer Authorizer
+	// ReadOnly rejects any write operation (receive-pack, or a mutating
+	// refs REST call) before Authorizer is even consulted.
+	ReadOnly bool
+}
+
+// registeredRepo is a repo together with the options it was registered
+// with.
+type registeredRepo struct {
+	repo *gogit.Repository
+	opts RepoOptions
+}
+
+// GitServer is a mock git server implementing "just enough" of the git
+// protocol, able to host multiple repos under distinct URL path prefixes.
+type GitServer struct {
+	mu    sync.RWMutex
+	repos map[string]*registeredRepo
+
+	// PackOptions controls how packfiles are built for every repo this
+	// server hosts. It's safe to modify the fields directly before the
+	// server starts serving requests; NewGitServer populates it with
+	// DefaultPackOptions().
+	PackOptions PackOptions
+}
+
+// NewGitServer constructs an empty GitServer; repos are added with
+// RegisterRepo.
+func NewGitServer() (*GitServer, error) {
+	return &GitServer{
+		repos:       map[string]*registeredRepo{},
+		PackOptions: DefaultPackOptions(),
+	}, nil
+}
+
+// RegisterRepo makes repo reachable under path, e.g. "/acme/demo.git" for
+// the smart HTTP endpoints (.../info/refs, .../git-upload-pack, ...) and the
+// refs REST API (/api/v1/repos/acme/demo/git/refs).
+func (s *GitServer) RegisterRepo(path string, repo *gogit.Repository, opts RepoOptions) {
+	key := normalizeRepoPath(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[key] = &registeredRepo{repo: repo, opts: opts}
+}
+
+// UnregisterRepo removes the repo registered under path, if any.
+func (s *GitServer) UnregisterRepo(path string) {
+	key := normalizeRepoPath(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.repos, key)
+}
+
+func (s *GitServer) lookupRepo(key string) (*registeredRepo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rr, ok := s.repos[key]
+	return rr, ok
+}
+
+// normalizeRepoPath trims slashes and a trailing ".git" so that "/acme/demo",
+// "/acme/demo/", and "/acme/demo.git" all resolve to the same registry key.
+func normalizeRepoPath(path string) string {
+	key := strings.Trim(path, "/")
+	key = strings.TrimSuffix(key, ".git")
+	return key
+}
+
+// authorize enforces rr's ReadOnly flag and Authorizer for a request,
+// writing a 401/403 response and returning false if the request should not
+// proceed.
+func authorize(w http.ResponseWriter, r *http.Request, rr *registeredRepo, write bool) bool {
+	if write && rr.opts.ReadOnly {
+		http.Error(w, "repository is read-only", http.StatusForbidden)
+		return false
+	}
+
+	if rr.opts.Authorizer == nil {
+		return true
+	}
+
+	if err := rr.opts.Authorizer.Authorize(r, write); err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+		return false
+	}
+
+	return true
+}
+
+// repoContextKey is the context key under which the resolved registeredRepo
+// is stored for the duration of a request.
+type repoContextKey struct{}
+
+func contextWithRepo(ctx context.Context, rr *registeredRepo) context.Context {
+	return context.WithValue(ctx, repoContextKey{}, rr)
+}
+
+// repoFromContext retrieves the repo bound to ctx by serveRequest. It panics
+// if called outside of a request that has already been routed to a
+// registered repo, which would be a bug in this package.
+func repoFromContext(ctx context.Context) *gogit.Repository {
+	rr, ok := ctx.Value(repoContextKey{}).(*registeredRepo)
+	if !ok {
+		panic("git: no repo bound in context")
+	}
+	return rr.repo
+}
+
+// basicAuthorizer grants access to requests presenting the given HTTP Basic
+// credentials.
+type basicAuthorizer struct {
+	username, password string
+}
+
+// BasicAuthorizer builds an Authorizer that requires the given HTTP Basic
+// username and password.
+func BasicAuthorizer(username, password string) Authorizer {
+	return &basicAuthorizer{username: username, password: password}
+}
+
+func (a *basicAuthorizer) Authorize(r *http.Request, write bool) error {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != a.username || pass != a.password {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// bearerTokenAuthorizer grants access to requests presenting the given
+// bearer token in the Authorization header.
+type bearerTokenAuthorizer struct {
+	token string
+}
+
+// BearerTokenAuthorizer builds an Authorizer that requires an
+// "Authorization: Bearer <token>" header with the given token.
+func BearerTokenAuthorizer(token string) Authorizer {
+	return &bearerTokenAuthorizer{token: token}
+}
+
+func (a *bearerTokenAuthorizer) Authorize(r *http.Request, write bool) error {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) || strings.TrimPrefix(h, prefix) != a.token {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// smartEndpoints are the path suffixes served by the git smart HTTP
+// protocol, following the ".git/" prefix of a registered repo's path.
+const (
+	endpointInfoRefs    = "info/refs"
+	endpointUploadPack  = "git-upload-pack"
+	endpointReceivePack = "git-receive-pack"
+)
+
+// resolveSmartRequest splits a smart-HTTP request path of the form
+// "/{owner}/{repo}.git/{endpoint}" into the repo's registry key and the
+// endpoint requested.
+func resolveSmartRequest(path string) (key string, endpoint string, ok bool) {
+	const sep = ".git/"
+	idx := strings.Index(path, sep)
+	if idx < 0 {
+		return "", "", false
+	}
+	return normalizeRepoPath(path[:idx]), path[idx+len(sep):], true
+}
+
+// serveRequest is the main dispatcher for http requests: it resolves which
+// registered repo a request targets, enforces that repo's auth, binds the
+// repo into the request context, and dispatches to the existing endpoint
+// handlers.
+func (s *GitServer) serveRequest(w http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+
+	if strings.HasPrefix(path, refsAPIPrefix) {
+		return s.serveRefsAPIRequest(w, r)
+	}
+
+	key, endpoint, ok := resolveSmartRequest(path)
+	if !ok {
+		klog.Warningf("404 for %s %s", r.Method, r.URL)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+
+	rr, ok := s.lookupRepo(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such repository %q", key), http.StatusNotFound)
+		return nil
+	}
+
+	switch endpoint {
+	case endpointInfoRefs:
+		if !authorize(w, r, rr, r.URL.Query().Get("service") == endpointReceivePack) {
+			return nil
+		}
+		r = r.WithContext(contextWithRepo(r.Context(), rr))
+		return s.serveGitInfoRefs(w, r)
+
+	case endpointUploadPack:
+		if !authorize(w, r, rr, false) {
+			return nil
+		}
+		r = r.WithContext(contextWithRepo(r.Context(), rr))
+		return s.serveGitUploadPack(w, r)
+
+	case endpointReceivePack:
+		if !authorize(w, r, rr, true) {
+			return nil
+		}
+		r = r.WithContext(contextWithRepo(r.Context(), rr))
+		return s.serveGitReceivePack(w, r)
+
+	default:
+		klog.Warningf("404 for %s %s", r.Method, r.URL)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return nil
+	}
+}
+
+// serveRefsAPIRequest resolves the repo named in a refs REST API path and
+// dispatches to serveRefsAPI with that repo bound in context.
+func (s *GitServer) serveRefsAPIRequest(w http.ResponseWriter, r *http.Request) error {
+	owner, repoName, _, ok := parseRefsAPIPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	rr, ok := s.lookupRepo(owner + "/" + repoName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such repository %q/%q", owner, repoName), http.StatusNotFound)
+		return nil
+	}
+
+	write := r.Method != http.MethodGet
+	if !authorize(w, r, rr, write) {
+		return nil
+	}
+
+	r = r.WithContext(contextWithRepo(r.Context(), rr))
+	return s.serveRefsAPI(w, r)
+}
@@ -0,0 +1,580 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// newTestRepo creates a bare in-memory repo with one commit on Main, and
+// returns it together with that commit's hash.
+func newTestRepo(t *testing.T) (*gogit.Repository, plumbing.Hash) {
+	t.Helper()
+
+	repo, err := gogit.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatalf("gogit.Init: %v", err)
+	}
+	if err := initRepo(repo); err != nil {
+		t.Fatalf("initRepo: %v", err)
+	}
+	ref, err := repo.Reference(Main, true)
+	if err != nil {
+		t.Fatalf("resolving %s: %v", Main, err)
+	}
+	return repo, ref.Hash()
+}
+
+// addCommit writes a new blob/tree/commit on top of parent (content
+// distinguishes the new blob from the one initRepo created) and moves Main
+// to point at it, returning the new commit's hash.
+func addCommit(t *testing.T, repo *gogit.Repository, parent plumbing.Hash, content string) plumbing.Hash {
+	t.Helper()
+	store := repo.Storer
+
+	blob := store.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	blob.SetSize(int64(len(content)))
+	w, err := blob.Writer()
+	if err != nil {
+		t.Fatalf("blob writer: %v", err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("writing blob: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing blob: %v", err)
+	}
+	blobHash, err := store.SetEncodedObject(blob)
+	if err != nil {
+		t.Fatalf("storing blob: %v", err)
+	}
+
+	tree := object.Tree{Entries: []object.TreeEntry{{Name: "README.md", Mode: filemode.Regular, Hash: blobHash}}}
+	treeObj := store.NewEncodedObject()
+	if err := tree.Encode(treeObj); err != nil {
+		t.Fatalf("encoding tree: %v", err)
+	}
+	treeHash, err := store.SetEncodedObject(treeObj)
+	if err != nil {
+		t.Fatalf("storing tree: %v", err)
+	}
+
+	now := time.Now()
+	commit := &object.Commit{
+		Author:       object.Signature{Name: "Porch Author", Email: "author@kpt.dev", When: now},
+		Committer:    object.Signature{Name: "Porch Committer", Email: "committer@kpt.dev", When: now},
+		Message:      content,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{parent},
+	}
+	commitObj := store.NewEncodedObject()
+	if err := commit.Encode(commitObj); err != nil {
+		t.Fatalf("encoding commit: %v", err)
+	}
+	commitHash, err := store.SetEncodedObject(commitObj)
+	if err != nil {
+		t.Fatalf("storing commit: %v", err)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(Main, commitHash)); err != nil {
+		t.Fatalf("updating %s: %v", Main, err)
+	}
+	return commitHash
+}
+
+// emptyPack returns a minimal, valid packfile containing zero objects, for
+// tests that only care about the ref-update preamble of a receive-pack
+// request.
+func emptyPack(t *testing.T) []byte {
+	t.Helper()
+	repo, err := gogit.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatalf("gogit.Init: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := packfile.NewEncoder(&buf, repo.Storer, false).Encode(nil, 0); err != nil {
+		t.Fatalf("encoding empty pack: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// packObjectCount reads the object count out of a packfile's 12-byte
+// header (magic "PACK", version, object count - all big-endian).
+func packObjectCount(t *testing.T, pack []byte) uint32 {
+	t.Helper()
+	if len(pack) < 12 || string(pack[:4]) != "PACK" {
+		t.Fatalf("not a packfile (len=%d)", len(pack))
+	}
+	return binary.BigEndian.Uint32(pack[8:12])
+}
+
+// uploadPackResponse is the parsed form of a git-upload-pack v0/v1 response:
+// the ACK/NAK preamble lines, and the packfile bytes - reassembled from
+// side-band-64k framing if the request asked for it.
+type uploadPackResponse struct {
+	preamble []string
+	progress string
+	pack     []byte
+}
+
+func doUploadPack(t *testing.T, serverURL string, wants, haves []plumbing.Hash, capabilities []string) uploadPackResponse {
+	t.Helper()
+
+	var body bytes.Buffer
+	pw := NewPacketLineWriter(&body)
+	for i, w := range wants {
+		line := "want " + w.String()
+		if i == 0 && len(capabilities) > 0 {
+			line += " " + strings.Join(capabilities, " ")
+		}
+		pw.WriteLine(line)
+	}
+	pw.WriteZeroPacketLine()
+	for _, h := range haves {
+		pw.WriteLine("have " + h.String())
+	}
+	pw.WriteLine("done")
+	if err := pw.Flush(); err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+
+	resp, err := http.Post(serverURL+"/acme/demo.git/git-upload-pack", "application/x-git-upload-pack-request", &body)
+	if err != nil {
+		t.Fatalf("POST git-upload-pack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("git-upload-pack: unexpected status %s", resp.Status)
+	}
+
+	sideBand := false
+	for _, c := range capabilities {
+		if c == capSideBand64k {
+			sideBand = true
+		}
+	}
+
+	var out uploadPackResponse
+	if !sideBand {
+		// In this mode the packfile that follows the ACK/NAK preamble is
+		// raw bytes with no pktline framing at all, so we can't run the
+		// whole response through a pktline scanner: peel off just the
+		// preamble lines by hand and treat everything left over as pack
+		// bytes.
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		out.preamble, out.pack = splitPreambleLines(t, raw)
+		return out
+	}
+
+	var packBuf bytes.Buffer
+	scanner := pktline.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		switch line[0] {
+		case sideBandData:
+			packBuf.Write(line[1:])
+		case sideBandProgress:
+			out.progress += string(line[1:])
+		case sideBandFatal:
+			t.Fatalf("server reported fatal error: %s", line[1:])
+		default:
+			out.preamble = append(out.preamble, strings.TrimSuffix(string(line), "\n"))
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		t.Fatalf("scanning response: %v", err)
+	}
+	out.pack = packBuf.Bytes()
+	return out
+}
+
+// splitPreambleLines consumes pktline-framed text lines off the front of
+// raw (the ACK/NAK preamble), stopping at the first four bytes that aren't
+// a valid pkt-line length - which is where the unframed packfile begins.
+func splitPreambleLines(t *testing.T, raw []byte) (lines []string, rest []byte) {
+	t.Helper()
+	for len(raw) >= 4 {
+		n, err := strconv.ParseUint(string(raw[:4]), 16, 16)
+		if err != nil || int(n) > len(raw) {
+			break
+		}
+		if n == 0 {
+			raw = raw[4:]
+			continue
+		}
+		lines = append(lines, strings.TrimSuffix(string(raw[4:n]), "\n"))
+		raw = raw[n:]
+	}
+	return lines, raw
+}
+
+func TestUploadPack(t *testing.T) {
+	repo, commit1 := newTestRepo(t)
+	commit2 := addCommit(t, repo, commit1, "Second commit")
+
+	s, err := NewGitServer()
+	if err != nil {
+		t.Fatalf("NewGitServer: %v", err)
+	}
+	s.RegisterRepo("/acme/demo.git", repo, RepoOptions{})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	t.Run("clone with no haves sends a plain NAK and every object", func(t *testing.T) {
+		resp := doUploadPack(t, server.URL, []plumbing.Hash{commit2}, nil,
+			[]string{capMultiAckDetailed, capOFSDelta, capThinPack})
+
+		if len(resp.preamble) != 1 || resp.preamble[0] != "NAK" {
+			t.Fatalf("preamble = %v, want [NAK]", resp.preamble)
+		}
+		// commit1 (blob, tree, commit) + commit2 (blob, tree, commit).
+		if got, want := packObjectCount(t, resp.pack), uint32(6); got != want {
+			t.Errorf("pack has %d objects, want %d", got, want)
+		}
+	})
+
+	t.Run("incremental fetch acks the common commit and omits it from the pack", func(t *testing.T) {
+		resp := doUploadPack(t, server.URL, []plumbing.Hash{commit2}, []plumbing.Hash{commit1},
+			[]string{capMultiAckDetailed, capOFSDelta, capThinPack})
+
+		want := []string{
+			fmt.Sprintf("ACK %s common", commit1),
+			fmt.Sprintf("ACK %s ready", commit1),
+		}
+		if len(resp.preamble) != len(want) {
+			t.Fatalf("preamble = %v, want %v", resp.preamble, want)
+		}
+		for i := range want {
+			if resp.preamble[i] != want[i] {
+				t.Errorf("preamble[%d] = %q, want %q", i, resp.preamble[i], want[i])
+			}
+		}
+		// Only commit2's new blob, tree and commit should be packed.
+		if got, want := packObjectCount(t, resp.pack), uint32(3); got != want {
+			t.Errorf("pack has %d objects, want %d", got, want)
+		}
+	})
+
+	t.Run("side-band-64k frames progress and packfile separately", func(t *testing.T) {
+		resp := doUploadPack(t, server.URL, []plumbing.Hash{commit2}, nil,
+			[]string{capMultiAckDetailed, capOFSDelta, capThinPack, capSideBand64k})
+
+		if len(resp.preamble) != 1 || resp.preamble[0] != "NAK" {
+			t.Fatalf("preamble = %v, want [NAK]", resp.preamble)
+		}
+		if resp.progress == "" {
+			t.Error("expected a progress message on band 2, got none")
+		}
+		if got, want := packObjectCount(t, resp.pack), uint32(6); got != want {
+			t.Errorf("pack has %d objects, want %d", got, want)
+		}
+	})
+}
+
+// parsePktLines splits raw into its individual pkt-line payloads, by hand:
+// unlike pktline.Scanner, it doesn't need to understand the protocol v2
+// delim-pkt (length "0001") to do so, which keeps this test independent of
+// whether a given go-git version's scanner recognizes it. Both flush-pkt and
+// delim-pkt are reported as an empty line, matching pktline.Scanner's
+// existing treatment of flush-pkt elsewhere in this file.
+func parsePktLines(t *testing.T, raw []byte) []string {
+	t.Helper()
+
+	var lines []string
+	for len(raw) > 0 {
+		if len(raw) < 4 {
+			t.Fatalf("truncated pkt-line length %x", raw)
+		}
+		n, err := strconv.ParseUint(string(raw[:4]), 16, 16)
+		if err != nil {
+			t.Fatalf("invalid pkt-line length %q: %v", raw[:4], err)
+		}
+		if n == 0 || n == 1 {
+			lines = append(lines, "")
+			raw = raw[4:]
+			continue
+		}
+		if int(n) > len(raw) {
+			t.Fatalf("pkt-line length %d exceeds remaining %d bytes", n, len(raw))
+		}
+		lines = append(lines, string(raw[4:n]))
+		raw = raw[n:]
+	}
+	return lines
+}
+
+// doFetchV2 posts a protocol v2 "fetch" command to the git-upload-pack
+// endpoint and reassembles the acknowledgments preamble and side-band-framed
+// packfile out of the response, the same way doUploadPack does for v0/v1.
+func doFetchV2(t *testing.T, serverURL string, wants, haves []plumbing.Hash, done bool) uploadPackResponse {
+	t.Helper()
+
+	var body bytes.Buffer
+	pw := NewPacketLineWriter(&body)
+	pw.WriteLine("command=fetch")
+	for _, w := range wants {
+		pw.WriteLine("want " + w.String())
+	}
+	for _, h := range haves {
+		pw.WriteLine("have " + h.String())
+	}
+	if done {
+		pw.WriteLine("done")
+	}
+	pw.WriteZeroPacketLine()
+	if err := pw.Flush(); err != nil {
+		t.Fatalf("building v2 fetch request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, serverURL+"/acme/demo.git/git-upload-pack", &body)
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST git-upload-pack (v2 fetch): %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("git-upload-pack (v2 fetch): unexpected status %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+
+	var out uploadPackResponse
+	var packBuf bytes.Buffer
+	inPackfile := false
+	for _, line := range parsePktLines(t, raw) {
+		if line == "" {
+			continue
+		}
+		if !inPackfile {
+			text := strings.TrimSuffix(line, "\n")
+			if text == "packfile" {
+				inPackfile = true
+			} else {
+				out.preamble = append(out.preamble, text)
+			}
+			continue
+		}
+		switch line[0] {
+		case sideBandData:
+			packBuf.WriteString(line[1:])
+		case sideBandProgress:
+			out.progress += line[1:]
+		case sideBandFatal:
+			t.Fatalf("server reported fatal error: %s", line[1:])
+		}
+	}
+	out.pack = packBuf.Bytes()
+	return out
+}
+
+func TestFetchV2(t *testing.T) {
+	repo, commit1 := newTestRepo(t)
+	commit2 := addCommit(t, repo, commit1, "Second commit")
+
+	s, err := NewGitServer()
+	if err != nil {
+		t.Fatalf("NewGitServer: %v", err)
+	}
+	s.RegisterRepo("/acme/demo.git", repo, RepoOptions{})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	t.Run("discovery advertises fetch without shallow", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/acme/demo.git/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatalf("building request: %v", err)
+		}
+		req.Header.Set("Git-Protocol", "version=2")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET info/refs (v2): %v", err)
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		lines := parsePktLines(t, raw)
+		found := false
+		for _, line := range lines {
+			line = strings.TrimSuffix(line, "\n")
+			if line == "fetch" {
+				found = true
+			}
+			if strings.HasPrefix(line, "fetch=") {
+				t.Errorf("advertised %q, fetch capabilities should not be parameterized", line)
+			}
+		}
+		if !found {
+			t.Errorf("lines = %v, want a bare %q", lines, "fetch")
+		}
+	})
+
+	t.Run("ls-refs lists the repo's references", func(t *testing.T) {
+		var body bytes.Buffer
+		pw := NewPacketLineWriter(&body)
+		pw.WriteLine("command=ls-refs")
+		pw.WriteZeroPacketLine()
+		if err := pw.Flush(); err != nil {
+			t.Fatalf("building request: %v", err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/acme/demo.git/git-upload-pack", &body)
+		if err != nil {
+			t.Fatalf("building request: %v", err)
+		}
+		req.Header.Set("Git-Protocol", "version=2")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST git-upload-pack (v2 ls-refs): %v", err)
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+
+		// HEAD is listed too, resolved to the commit it points at. Refs come
+		// back in storage iteration order, so compare them sorted.
+		want := []string{
+			fmt.Sprintf("%s %s", commit2, plumbing.HEAD),
+			fmt.Sprintf("%s %s", commit2, Main),
+		}
+		var got []string
+		for _, line := range parsePktLines(t, raw) {
+			if line != "" {
+				got = append(got, strings.TrimSuffix(line, "\n"))
+			}
+		}
+		sort.Strings(got)
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Fatalf("ls-refs = %v, want %q", got, want)
+		}
+	})
+
+	t.Run("clone with no haves sends a plain NAK-free packfile section", func(t *testing.T) {
+		resp := doFetchV2(t, server.URL, []plumbing.Hash{commit2}, nil, true)
+
+		if len(resp.preamble) != 0 {
+			t.Fatalf("preamble = %v, want none (no haves sent)", resp.preamble)
+		}
+		if got, want := packObjectCount(t, resp.pack), uint32(6); got != want {
+			t.Errorf("pack has %d objects, want %d", got, want)
+		}
+	})
+
+	t.Run("incremental fetch acks the common commit and omits it from the pack", func(t *testing.T) {
+		resp := doFetchV2(t, server.URL, []plumbing.Hash{commit2}, []plumbing.Hash{commit1}, true)
+
+		want := []string{"acknowledgments", fmt.Sprintf("ACK %s", commit1)}
+		if len(resp.preamble) != len(want) {
+			t.Fatalf("preamble = %v, want %v", resp.preamble, want)
+		}
+		for i := range want {
+			if resp.preamble[i] != want[i] {
+				t.Errorf("preamble[%d] = %q, want %q", i, resp.preamble[i], want[i])
+			}
+		}
+		if got, want := packObjectCount(t, resp.pack), uint32(3); got != want {
+			t.Errorf("pack has %d objects, want %d", got, want)
+		}
+	})
+}
+
+func TestReceivePackRejectsNonFastForward(t *testing.T) {
+	repo, commit1 := newTestRepo(t)
+
+	s, err := NewGitServer()
+	if err != nil {
+		t.Fatalf("NewGitServer: %v", err)
+	}
+	s.RegisterRepo("/acme/demo.git", repo, RepoOptions{})
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// Claim the ref was at a commit it was never at (stale "from"), rather
+	// than its actual current value (commit1). The bogus "to" need not
+	// resolve to a real object: a stale-info rejection is decided from the
+	// ref precondition alone, before connectivity is even checked.
+	staleFrom := plumbing.NewHash("1111111111111111111111111111111111111111")
+	bogusTo := plumbing.NewHash("2222222222222222222222222222222222222222")
+
+	var body bytes.Buffer
+	pw := NewPacketLineWriter(&body)
+	pw.WriteLine(fmt.Sprintf("%s %s refs/heads/main\x00report-status", staleFrom, bogusTo))
+	pw.WriteZeroPacketLine()
+	if err := pw.Flush(); err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	body.Write(emptyPack(t))
+
+	resp, err := http.Post(server.URL+"/acme/demo.git/git-receive-pack", "application/x-git-receive-pack-request", &body)
+	if err != nil {
+		t.Fatalf("POST git-receive-pack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("git-receive-pack: unexpected status %s", resp.Status)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if !bytes.Contains(respBody, []byte("unpack ok")) {
+		t.Errorf("response %q does not report unpack ok", respBody)
+	}
+
+	ref, err := repo.Reference(Main, true)
+	if err != nil {
+		t.Fatalf("resolving %s after push: %v", Main, err)
+	}
+	if ref.Hash() != commit1 {
+		t.Errorf("%s = %s after rejected push, want unchanged %s", Main, ref.Hash(), commit1)
+	}
+}
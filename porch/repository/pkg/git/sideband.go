@@ -0,0 +1,54 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+// side-band-64k bands, see
+// https://git-scm.com/docs/protocol-capabilities#_side_band_side_band_64k
+const (
+	sideBandData     byte = 1
+	sideBandProgress byte = 2
+	sideBandFatal    byte = 3
+)
+
+// maxSideBandChunk is the largest amount of payload that fits in a single
+// side-band-64k pktline: 65520 (the max pktline size) minus the 4 byte
+// length prefix and the 1 byte band indicator.
+const maxSideBandChunk = 65520 - 4 - 1
+
+// sideBandWriter is an io.Writer that frames everything written to it as
+// side-band-64k pktlines on the given band, splitting writes larger than a
+// single pktline can carry.
+type sideBandWriter struct {
+	out  *PacketLineWriter
+	band byte
+}
+
+func (w *sideBandWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxSideBandChunk {
+			n = maxSideBandChunk
+		}
+		w.out.WriteBand(w.band, p[:n])
+		p = p[n:]
+	}
+	return total, w.out.err
+}
+
+// WriteString is a convenience wrapper used for progress/error messages.
+func (w *sideBandWriter) WriteString(s string) {
+	_, _ = w.Write([]byte(s))
+}
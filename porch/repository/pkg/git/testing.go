@@ -16,6 +16,7 @@ package git
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/hex"
@@ -23,6 +24,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,18 +42,6 @@ const (
 	Main plumbing.ReferenceName = "refs/heads/main"
 )
 
-// GitServer is a mock git server implementing "just enough" of the git protocol
-type GitServer struct {
-	repo *gogit.Repository
-}
-
-// NewGitServer constructs a GitServer backed by the specified repo.
-func NewGitServer(repo *gogit.Repository) (*GitServer, error) {
-	return &GitServer{
-		repo: repo,
-	}, nil
-}
-
 // ListenAndServe starts the git server on "listen".
 // The address we actually start listening on will be posted to addressChannel
 func (s *GitServer) ListenAndServe(ctx context.Context, listen string, addressChannel chan<- net.Addr) error {
@@ -96,26 +86,12 @@ func (s *GitServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// serveRequest is the main dispatcher for http requests.
-func (s *GitServer) serveRequest(w http.ResponseWriter, r *http.Request) error {
-	path := r.URL.Path
-	if path == "/info/refs" {
-		return s.serveGitInfoRefs(w, r)
-	}
-	if path == "/git-upload-pack" {
-		return s.serveGitUploadPack(w, r)
-	}
-	if path == "/git-receive-pack" {
-		return s.serveGitReceivePack(w, r)
-	}
-
-	klog.Warningf("404 for %s %s", r.Method, r.URL)
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-	return nil
-}
-
 // serveGitInfoRefs serves the info/refs (discovery) endpoint
 func (s *GitServer) serveGitInfoRefs(w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Git-Protocol") == "version=2" {
+		return s.serveGitInfoRefsV2(w, r)
+	}
+
 	query := r.URL.Query()
 	serviceName := query.Get("service")
 
@@ -124,7 +100,14 @@ func (s *GitServer) serveGitInfoRefs(w http.ResponseWriter, r *http.Request) err
 	switch serviceName {
 	case "git-upload-pack":
 		// OK
-		capabilities = append(capabilities, "symref=HEAD:refs/heads/main")
+		capabilities = append(capabilities,
+			"symref=HEAD:refs/heads/main",
+			capMultiAckDetailed,
+			capNoDone,
+			capOFSDelta,
+			capSideBand64k,
+			capThinPack,
+		)
 
 	case "git-receive-pack":
 		// OK
@@ -135,44 +118,20 @@ func (s *GitServer) serveGitInfoRefs(w http.ResponseWriter, r *http.Request) err
 	}
 
 	// We send an advertisement for each of our references
-	it, err := s.repo.References()
+	refList, err := resolvedRefs(repoFromContext(r.Context()))
 	if err != nil {
-		return fmt.Errorf("failed to get git references: %w", err)
+		return fmt.Errorf("error iterating through references: %w", err)
 	}
 	var refs []string
-	if err := it.ForEach(func(ref *plumbing.Reference) error {
-		name := ref.Name()
-		if name.IsRemote() {
-			klog.Infof("skipping remote ref %q", name)
-			return nil
-		}
-
-		var resolved *plumbing.Reference
-		switch ref.Type() {
-		case plumbing.SymbolicReference:
-			if r, err := s.repo.Reference(ref.Name(), true); err != nil {
-				klog.Warningf("Skippling unresolvable symbolic reference %q: %w", ref.Name(), err)
-				return nil
-			} else {
-				resolved = r
-			}
-		case plumbing.HashReference:
-			resolved = ref
-		default:
-			return fmt.Errorf("unexpected reference encountered: %s", ref)
-		}
-
-		s := fmt.Sprintf("%s %s", resolved.Hash().String(), name)
+	for _, resolved := range refList {
+		s := fmt.Sprintf("%s %s", resolved.Hash().String(), resolved.Name())
 
 		// https://git-scm.com/docs/http-protocol: HEAD SHOULD be first
-		if name == plumbing.HEAD {
+		if resolved.Name() == plumbing.HEAD {
 			refs = append([]string{s}, refs...)
 		} else {
 			refs = append(refs, s)
 		}
-		return nil
-	}); err != nil {
-		return fmt.Errorf("error iterating through references: %w", err)
 	}
 
 	w.Header().Set("Content-Type", "application/x-"+serviceName+"-advertisement")
@@ -204,67 +163,162 @@ func (s *GitServer) serveGitInfoRefs(w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
-// serveGitUploadPack serves the git-upload-pack endpoint
-func (s *GitServer) serveGitUploadPack(w http.ResponseWriter, r *http.Request) error {
-	// See https://git-scm.com/docs/pack-protocol/2.2.3#_packfile_negotiation
+// resolvedRefs returns every local (non-remote) reference in the repo, with
+// symbolic references such as HEAD resolved to a hash reference that keeps
+// the symbolic reference's own name (e.g. "HEAD" rather than the name of
+// whatever it points at).
+func resolvedRefs(repo *gogit.Repository) ([]*plumbing.Reference, error) {
+	it, err := repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git references: %w", err)
+	}
 
-	// The client sends a line for each sha it wants and each sha it has
-	scanner := pktline.NewScanner(r.Body)
-	for {
-		if !scanner.Scan() {
-			err := scanner.Err()
+	var refs []*plumbing.Reference
+	if err := it.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		if name.IsRemote() {
+			klog.Infof("skipping remote ref %q", name)
+			return nil
+		}
+
+		switch ref.Type() {
+		case plumbing.SymbolicReference:
+			target, err := repo.Reference(ref.Name(), true)
 			if err != nil {
-				return fmt.Errorf("error parsing request: %w", err)
+				klog.Warningf("skipping unresolvable symbolic reference %q: %v", name, err)
+				return nil
 			}
-			break
+			refs = append(refs, plumbing.NewHashReference(name, target.Hash()))
+		case plumbing.HashReference:
+			refs = append(refs, ref)
+		default:
+			return fmt.Errorf("unexpected reference encountered: %s", ref)
 		}
-		line := scanner.Bytes()
-		klog.V(4).Infof("request line: %s", string(line))
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	// We implement a very dumb version of the protocol; we always send everything
-	// This works, and is correct on the "clean pull" scenario, but is not efficient in the real world.
+	return refs, nil
+}
 
-	// Gather all the objects
-	walker := newObjectWalker(s.repo.Storer)
-	if err := walker.walkAllRefs(); err != nil {
-		return fmt.Errorf("error walking refs: %w", err)
-	}
+// serveGitUploadPack serves the git-upload-pack endpoint
+func (s *GitServer) serveGitUploadPack(w http.ResponseWriter, r *http.Request) error {
+	// See https://git-scm.com/docs/pack-protocol/2.2.3#_packfile_negotiation
 
-	objects := make([]plumbing.Hash, 0, len(walker.seen))
-	for h := range walker.seen {
-		objects = append(objects, h)
+	if r.Header.Get("Git-Protocol") == "version=2" {
+		return s.serveGitUploadPackV2(w, r)
 	}
 
-	// Send a NAK indicating we're sending everything
-	encoder := NewPacketLineWriter(w)
-	encoder.WriteLine("NAK")
-	if err := encoder.Flush(); err != nil {
-		klog.Warningf("error encoding response: %v", err)
-		return nil // Too late
+	repo := repoFromContext(r.Context())
+
+	scanner := pktline.NewScanner(r.Body)
+	req, err := parseUploadPackRequest(scanner)
+	if err != nil {
+		return fmt.Errorf("error parsing upload-pack request: %w", err)
+	}
+	if req.isShallowRequest() {
+		// We don't advertise "shallow", so a well-behaved client won't send
+		// these; reject explicitly rather than silently sending full history.
+		return fmt.Errorf("shallow clones are not supported")
 	}
 
-	// Send the packfile data
-	klog.Infof("sending %d objects in packfile", len(objects))
+	klog.V(2).Infof("upload-pack wants=%v haves=%v capabilities=%v", req.Wants, req.Haves, req.Capabilities)
 
-	useRefDeltas := false
-	storer := s.repo.Storer
+	multiAckDetailed := hasCapability(req.Capabilities, capMultiAckDetailed)
+	sideBand := hasCapability(req.Capabilities, capSideBand64k)
+	useRefDeltas := s.PackOptions.UseRefDeltas || !hasCapability(req.Capabilities, capOFSDelta)
 
-	// TODO: Buffer on disk first?
-	packFileEncoder := packfile.NewEncoder(w, storer, useRefDeltas)
+	// Walk from the wants, pruning the walk at each have we actually
+	// possess. Objects that the wants' own trees share with a have's history
+	// are still packed; only what lies below a have is left out.
+	walker := newObjectWalker(repo.Storer)
+	result, err := negotiateObjects(walker, req.Wants, req.Haves)
+	if err != nil {
+		return fmt.Errorf("error negotiating objects: %w", err)
+	}
+
+	// The ACK/NAK preamble is built into its own buffer so that its size can
+	// be folded into the Content-Length we send once the packfile (encoded
+	// below) is ready, instead of relying on chunked transfer encoding.
+	var preamble bytes.Buffer
+	preWriter := NewPacketLineWriter(&preamble)
+	switch {
+	case len(result.Common) == 0:
+		// Nothing in common (or the client sent no haves): a plain NAK,
+		// we're about to send everything reachable from the wants.
+		preWriter.WriteLine("NAK")
+	case multiAckDetailed:
+		for _, h := range result.Common {
+			preWriter.WriteLine(fmt.Sprintf("ACK %s common", h))
+		}
+		// We don't do multi-round negotiation, so as soon as we've seen the
+		// client's haves we know enough to build the pack; tell it so.
+		preWriter.WriteLine(fmt.Sprintf("ACK %s ready", result.Common[len(result.Common)-1]))
+	default:
+		// Plain multi_ack/old clients: ACK the last common commit.
+		preWriter.WriteLine(fmt.Sprintf("ACK %s", result.Common[len(result.Common)-1]))
+	}
+	if err := preWriter.Flush(); err != nil {
+		return fmt.Errorf("error building response preamble: %w", err)
+	}
 
-	// packWindow specifies the size of the sliding window used
-	// to compare objects for delta compression;
-	// 0 turns off delta compression entirely.
-	packWindow := uint(0)
+	klog.Infof("sending %d objects in packfile (%d common with client)", len(result.Objects), len(result.Common))
 
-	packfileHash, err := packFileEncoder.Encode(objects, packWindow)
+	// Encode the pack into a spool (in memory while small, spilling to a
+	// temp file past PackOptions.MaxMemBytes) rather than directly onto the
+	// response, so we know its final size before writing any of it.
+	spool := &packSpool{maxMemBytes: s.PackOptions.MaxMemBytes, bufferDir: s.PackOptions.BufferDir}
+	packFileEncoder := packfile.NewEncoder(spool, repo.Storer, useRefDeltas)
+	packfileHash, err := packFileEncoder.Encode(result.Objects, s.PackOptions.Window)
+	if err != nil {
+		return fmt.Errorf("error encoding packfile: %w", err)
+	}
+	packReader, packSize, err := spool.Finalize()
 	if err != nil {
-		klog.Warningf("error encoding packfile: %v", err)
+		return fmt.Errorf("error finalizing packfile buffer: %w", err)
+	}
+	defer packReader.Close()
+
+	klog.Infof("packed as %v (%d bytes)", packfileHash, packSize)
+
+	var progressMsg string
+	contentLength := int64(preamble.Len())
+	if sideBand {
+		progressMsg = fmt.Sprintf("porch mock git server: sending %d objects (%d bytes)\n", len(result.Objects), packSize)
+		contentLength += sideBandFramedLen(int64(len(progressMsg))) + sideBandFramedLen(packSize) + 4 // + trailing flush-pkt
+	} else {
+		contentLength += packSize
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(preamble.Bytes()); err != nil {
+		klog.Warningf("error writing response preamble: %v", err)
 		return nil // Too late
 	}
 
-	klog.Infof("packed as %v", packfileHash)
+	if !sideBand {
+		if _, err := io.Copy(w, packReader); err != nil {
+			klog.Warningf("error streaming packfile: %v", err)
+		}
+		return nil
+	}
+
+	gitWriter := NewPacketLineWriter(w)
+	progress := &sideBandWriter{out: gitWriter, band: sideBandProgress}
+	progress.WriteString(progressMsg)
+	if err := copyToSideBand(gitWriter, sideBandData, packReader); err != nil {
+		klog.Warningf("error streaming packfile: %v", err)
+		return nil
+	}
+	gitWriter.WriteZeroPacketLine()
+	if err := gitWriter.Flush(); err != nil {
+		klog.Warningf("error flushing response: %v", err)
+	}
 
 	return nil
 }
@@ -279,6 +333,8 @@ type RefUpdate struct {
 }
 
 func (s *GitServer) serveGitReceivePack(w http.ResponseWriter, r *http.Request) error {
+	repo := repoFromContext(r.Context())
+
 	var refUpdates []RefUpdate
 
 	body := r.Body
@@ -355,7 +411,8 @@ func (s *GitServer) serveGitReceivePack(w http.ResponseWriter, r *http.Request)
 	klog.V(2).Infof("clientCapabilites %v", clientCapabilites)
 	klog.V(2).Infof("updates %+v", refUpdates)
 
-	// TODO: In a real implementation, we would check the shas here
+	reportStatus := hasCapability(clientCapabilites, "report-status")
+	atomic := hasCapability(clientCapabilites, "atomic")
 
 	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -363,34 +420,57 @@ func (s *GitServer) serveGitReceivePack(w http.ResponseWriter, r *http.Request)
 
 	gitWriter := NewPacketLineWriter(w)
 
-	if err := packfile.UpdateObjectStorage(s.repo.Storer, body); err != nil {
+	if err := packfile.UpdateObjectStorage(repo.Storer, body); err != nil {
 		klog.Warningf("error parsing packfile: %v", err)
 		gitWriter.WriteLine("unpack error parsing packfile")
 		gitWriter.Flush()
 		return nil
 	}
 
-	// TODO: In a real implementation, we would validate the packfile data
+	// Check each update's non-force-push precondition and the connectivity
+	// of the object graph it points at before touching any reference.
+	results := validateRefUpdates(repo, refUpdates)
+	if atomic {
+		if failed := firstFailedUpdate(results); failed != nil {
+			for i := range results {
+				if results[i].err == nil {
+					results[i].err = fmt.Errorf("transaction aborted: %s failed its check: %v", failed.update.Ref, failed.err)
+				}
+			}
+		}
+	}
+
+	// Having validated the updates, apply the ones that passed.
+	for i, res := range results {
+		if res.err != nil {
+			klog.Warningf("rejecting update of %v: %v", res.update, res.err)
+			continue
+		}
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(res.update.Ref), res.update.To)
+		if err := repo.Storer.SetReference(ref); err != nil {
+			results[i].err = fmt.Errorf("error updating reference: %w", err)
+			klog.Warningf("failed to update reference %v: %v", res.update, err)
+			continue
+		}
+		klog.Infof("updated reference %v -> %v", res.update.Ref, res.update.To)
+	}
 
 	gitWriter.WriteLine("unpack ok")
+	if reportStatus {
+		for _, res := range results {
+			if res.err != nil {
+				gitWriter.WriteLine(fmt.Sprintf("ng %s %s", res.update.Ref, res.err))
+			} else {
+				gitWriter.WriteLine(fmt.Sprintf("ok %s", res.update.Ref))
+			}
+		}
+	}
 	gitWriter.WriteZeroPacketLine()
 	if err := gitWriter.Flush(); err != nil {
-		klog.Warningf("error flushing response: %w", err)
+		klog.Warningf("error flushing response: %v", err)
 		return nil // too late for real errors
 	}
 
-	// Having accepted the packfile into our store, we should update the SHAs
-
-	// TODO: Concurrency, if we ever pull this out of test code
-	for _, refUpdate := range refUpdates {
-		ref := plumbing.NewHashReference(plumbing.ReferenceName(refUpdate.Ref), refUpdate.To)
-		if err := s.repo.Storer.SetReference(ref); err != nil {
-			klog.Warningf("failed to update reference %v: %v", refUpdate, err)
-		} else {
-			klog.Warningf("updated reference %v -> %v", refUpdate.Ref, refUpdate.To)
-		}
-	}
-
 	return nil
 }
 
@@ -402,28 +482,15 @@ type objectWalker struct {
 	// seen map can become huge if walking over large
 	// repos. Thus using struct{} as the value type.
 	seen map[plumbing.Hash]struct{}
+	// stopAt holds commit hashes at which walkObjectTree should stop
+	// descending: the commit itself (and everything reachable from it) is
+	// assumed to already be known to whoever is asking for the walk. It is
+	// used to prune the negotiation walk at the client's "haves".
+	stopAt map[plumbing.Hash]struct{}
 }
 
 func newObjectWalker(s storage.Storer) *objectWalker {
-	return &objectWalker{s, map[plumbing.Hash]struct{}{}}
-}
-
-// walkAllRefs walks all (hash) references from the repo.
-func (p *objectWalker) walkAllRefs() error {
-	// Walk over all the references in the repo.
-	it, err := p.Storer.IterReferences()
-	if err != nil {
-		return err
-	}
-	defer it.Close()
-	err = it.ForEach(func(ref *plumbing.Reference) error {
-		// Exit this iteration early for non-hash references.
-		if ref.Type() != plumbing.HashReference {
-			return nil
-		}
-		return p.walkObjectTree(ref.Hash())
-	})
-	return err
+	return &objectWalker{Storer: s, seen: map[plumbing.Hash]struct{}{}}
 }
 
 func (p *objectWalker) isSeen(hash plumbing.Hash) bool {
@@ -443,6 +510,12 @@ func (p *objectWalker) walkObjectTree(hash plumbing.Hash) error {
 	if p.isSeen(hash) {
 		return nil
 	}
+	if _, stop := p.stopAt[hash]; stop {
+		// This is one of the caller's "haves": mark it seen so we don't
+		// walk into it again, but don't descend any further below it.
+		p.add(hash)
+		return nil
+	}
 	p.add(hash)
 	// Fetch the object.
 	obj, err := object.GetObject(p.Storer, hash)
@@ -467,6 +540,15 @@ func (p *objectWalker) walkObjectTree(hash plumbing.Hash) error {
 		for i := range obj.Entries {
 			switch obj.Entries[i].Mode {
 			case filemode.Executable, filemode.Regular, filemode.Symlink:
+				if p.isSeen(obj.Entries[i].Hash) {
+					continue nextEntry
+				}
+				// Blobs have no children to walk into, but we still need to
+				// confirm the object itself is present: a thin or corrupt
+				// pack can omit a referenced blob entirely.
+				if err := p.Storer.HasEncodedObject(obj.Entries[i].Hash); err != nil {
+					return fmt.Errorf("missing blob %s: %w", obj.Entries[i].Hash, err)
+				}
 				p.add(obj.Entries[i].Hash)
 				continue nextEntry
 			case filemode.Submodule:
@@ -654,6 +736,31 @@ func (w *PacketLineWriter) WriteLine(s string) {
 	klog.V(4).Infof("writing pktline %q", s)
 }
 
+// WriteBand frames data as a pktline prefixed with a side-band-64k band byte
+// (1 = pack data, 2 = progress messages, 3 = fatal error), per
+// https://git-scm.com/docs/protocol-capabilities#_side_band_side_band_64k
+func (w *PacketLineWriter) WriteBand(band byte, data []byte) {
+	if w.err != nil {
+		return
+	}
+
+	n := 4 + 1 + len(data)
+	prefix := fmt.Sprintf("%04x", n)
+
+	if _, err := w.w.Write([]byte(prefix)); err != nil {
+		w.err = err
+		return
+	}
+	if err := w.w.WriteByte(band); err != nil {
+		w.err = err
+		return
+	}
+	if _, err := w.w.Write(data); err != nil {
+		w.err = err
+		return
+	}
+}
+
 // WriteZeroPacketLine writes a special "0000" line - often used to indicate the end of a block in the git protocol
 func (w *PacketLineWriter) WriteZeroPacketLine() {
 	if w.err != nil {
@@ -666,4 +773,20 @@ func (w *PacketLineWriter) WriteZeroPacketLine() {
 	}
 
 	klog.V(4).Infof("writing pktline 0000")
-}
\ No newline at end of file
+}
+
+// WriteDelimPacketLine writes a special "0001" line - the protocol v2
+// delim-pkt used to separate sections within a single response, as opposed
+// to WriteZeroPacketLine's flush-pkt which ends the response entirely.
+func (w *PacketLineWriter) WriteDelimPacketLine() {
+	if w.err != nil {
+		return
+	}
+
+	if _, err := w.w.Write([]byte("0001")); err != nil {
+		w.err = err
+		return
+	}
+
+	klog.V(4).Infof("writing pktline 0001")
+}